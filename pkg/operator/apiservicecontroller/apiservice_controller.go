@@ -0,0 +1,562 @@
+package apiservicecontroller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	operatorv1helpers "github.com/openshift/library-go/pkg/operator/v1helpers"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+	apiregistrationinformers "k8s.io/kube-aggregator/pkg/client/informers/externalversions"
+	apiregistrationclientv1 "k8s.io/kube-aggregator/pkg/client/clientset_generated/clientset/typed/apiregistration/v1"
+)
+
+// apiServiceOwnerLabel is written onto every APIService this controller
+// creates or updates (including pre-existing ones it adopts), so sync() can
+// tell "an APIService we manage and now want to remove" apart from one
+// belonging to something else entirely.
+const apiServiceOwnerLabel = "apiservices.apiregistration.openshift.io/managed-by"
+
+const apiServicesAvailable = "APIServicesAvailable"
+
+// APIServiceDescriptor pairs an APIService this operator wants to apply with an
+// optional ownership predicate. Most APIServices are unconditionally owned by
+// this operator (Owned is nil), but some are in the process of being handed off
+// to a dedicated operator (see cluster-authentication-operator's
+// UnmanageOAuthAPIController for the OAuth case). When Owned is set and returns
+// false, the APIServiceController leaves the APIService alone, does not count it
+// toward APIServicesAvailable, and instead publishes OwnedConditionType=False so
+// the new owner can safely take over.
+type APIServiceDescriptor struct {
+	APIService *apiregistrationv1.APIService
+
+	// Owned, when non-nil, is re-evaluated on every sync to decide whether this
+	// operator still manages APIService. A nil Owned means "always owned".
+	Owned func(ctx context.Context) (bool, error)
+
+	// OwnedConditionType, when non-empty, is published on the operator status
+	// every sync to reflect the current result of Owned: True while this
+	// operator manages the APIService, False once it has been handed off. On a
+	// sync where Owned returns an error the condition is left unchanged.
+	OwnedConditionType string
+}
+
+// APIServiceController is a controller that ensures the set of APIServices this
+// operator is responsible for exist and are available, and reflects that as the
+// APIServicesAvailable operator condition.
+type APIServiceController struct {
+	// name identifies this controller as the owner of the APIServices it
+	// creates or adopts, via apiServiceOwnerLabel, so it can find and remove ones that
+	// apiServiceProvider has since dropped.
+	name string
+
+	apiServiceProvider APIServiceSetProvider
+
+	// precondition gates the entire sync, e.g. until the operand deployment has
+	// rolled out far enough that the aggregator has something to talk to.
+	precondition func() (bool, error)
+
+	operatorClient          operatorv1helpers.OperatorClient
+	apiregistrationv1Client apiregistrationclientv1.ApiregistrationV1Interface
+	kubeClient              kubernetes.Interface
+	eventRecorder           events.Recorder
+
+	// dialEndpoint probes a single endpoint address over TLS so diagnoseAPIService
+	// can tell a cert problem from a refused connection. Overridden in tests.
+	dialEndpoint func(address string, caBundle []byte) error
+
+	// clock is used by the per-APIService backoff tracker. Overridden in tests
+	// with a clock.FakeClock.
+	clock clock.PassiveClock
+
+	backoffMu sync.Mutex
+	backoffs  map[string]*apiServiceBackoff
+}
+
+// apiServiceBackoff tracks consecutive availability failures for a single
+// APIService so a flapping aggregator probe doesn't make the operator rewrite
+// the APIServicesAvailable condition many times a minute.
+type apiServiceBackoff struct {
+	lastFailure time.Time
+	attempt     int
+	lastReason  string
+	lastMessage string
+}
+
+const (
+	backoffInitial = 5 * time.Second
+	backoffFactor  = 2.0
+	backoffCap     = 2 * time.Minute
+	backoffJitter  = 0.2
+)
+
+// nextDelay returns how long to wait before re-checking an APIService that has
+// now failed attempt times in a row, within backoffCap and with up to ±20%
+// jitter so a fleet of flapping APIServices doesn't resync in lockstep.
+func nextDelay(attempt int) time.Duration {
+	delay := float64(backoffInitial) * math.Pow(backoffFactor, float64(attempt-1))
+	if delay > float64(backoffCap) {
+		delay = float64(backoffCap)
+	}
+	jitter := 1 + backoffJitter*(2*rand.Float64()-1)
+	return time.Duration(delay * jitter)
+}
+
+// Machine-readable reasons diagnoseAPIService can attach to an unavailable
+// APIService, surfaced as the APIServicesAvailable condition's Reason.
+const (
+	reasonServiceNotFound       = "ServiceNotFound"
+	reasonMissingEndpoints      = "MissingEndpoints"
+	reasonTLSHandshakeFailed    = "TLSHandshakeFailed"
+	reasonConnectionRefused     = "ConnectionRefused"
+	reasonAggregatorProbeFailed = "AggregatorProbeFailed"
+)
+
+// diagnosedError is an ensureAPIService failure that has already been
+// classified by diagnoseAPIService, so sync() can surface a machine-readable
+// reason instead of the generic "Error".
+type diagnosedError struct {
+	reason  string
+	message string
+}
+
+func (e *diagnosedError) Error() string { return e.message }
+
+// NewAPIServiceController returns a controller that applies the APIServices
+// returned by apiServiceProvider and reports their availability as the
+// APIServicesAvailable operator condition.
+func NewAPIServiceController(
+	name string,
+	apiServiceProvider APIServiceSetProvider,
+	precondition func() (bool, error),
+	operatorClient operatorv1helpers.OperatorClient,
+	apiregistrationv1Client apiregistrationclientv1.ApiregistrationV1Interface,
+	apiregistrationInformers apiregistrationinformers.SharedInformerFactory,
+	kubeClient kubernetes.Interface,
+	eventRecorder events.Recorder,
+) factory.Controller {
+	c := &APIServiceController{
+		name:                    name,
+		apiServiceProvider:      apiServiceProvider,
+		precondition:            precondition,
+		operatorClient:          operatorClient,
+		apiregistrationv1Client: apiregistrationv1Client,
+		kubeClient:              kubeClient,
+		eventRecorder:           eventRecorder,
+		dialEndpoint:            dialTLSEndpoint,
+		clock:                   clock.RealClock{},
+		backoffs:                map[string]*apiServiceBackoff{},
+	}
+
+	return factory.New().
+		WithSync(func(ctx context.Context, _ factory.SyncContext) error { return c.sync() }).
+		ResyncEvery(10*time.Second).
+		WithInformers(
+			operatorClient.Informer(),
+			apiregistrationInformers.Apiregistration().V1().APIServices().Informer(),
+		).
+		ToController(name+"APIServiceController", eventRecorder)
+}
+
+func (c *APIServiceController) sync() error {
+	ctx := context.TODO()
+
+	operatorSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if operatorSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	if c.precondition != nil {
+		fulfilled, err := c.precondition()
+		if err != nil {
+			return err
+		}
+		if !fulfilled {
+			return nil
+		}
+	}
+
+	desired, err := c.apiServiceProvider.DesiredAPIServices(ctx)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	ownershipConditions := make([]operatorv1.OperatorCondition, 0, len(desired))
+	desiredNames := sets.NewString()
+
+	for _, desc := range desired {
+		desiredNames.Insert(desc.APIService.Name)
+		if desc.Owned != nil {
+			owned, err := desc.Owned(ctx)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if !owned {
+				if desc.OwnedConditionType != "" {
+					ownershipConditions = append(ownershipConditions, operatorv1.OperatorCondition{
+						Type:    desc.OwnedConditionType,
+						Status:  operatorv1.ConditionFalse,
+						Reason:  "HandedOff",
+						Message: fmt.Sprintf("%s is now managed by another operator", desc.APIService.Name),
+					})
+				}
+				continue
+			}
+		}
+
+		if err := c.syncAPIService(desc.APIService); err != nil {
+			errs = append(errs, err)
+		}
+
+		if desc.OwnedConditionType != "" {
+			ownershipConditions = append(ownershipConditions, operatorv1.OperatorCondition{
+				Type:   desc.OwnedConditionType,
+				Status: operatorv1.ConditionTrue,
+				Reason: "AsExpected",
+			})
+		}
+	}
+
+	if err := c.pruneRetiredAPIServices(desiredNames); err != nil {
+		errs = append(errs, err)
+	}
+
+	availableCondition := operatorv1.OperatorCondition{
+		Type:   apiServicesAvailable,
+		Status: operatorv1.ConditionTrue,
+	}
+	if len(errs) > 0 {
+		availableCondition.Status = operatorv1.ConditionFalse
+		availableCondition.Reason = aggregateReason(errs)
+		availableCondition.Message = utilerrors.NewAggregate(errs).Error()
+	}
+
+	updateFns := make([]operatorv1helpers.UpdateStatusFunc, 0, len(ownershipConditions)+1)
+	updateFns = append(updateFns, operatorv1helpers.UpdateConditionFn(availableCondition))
+	for _, cond := range ownershipConditions {
+		updateFns = append(updateFns, operatorv1helpers.UpdateConditionFn(cond))
+	}
+
+	_, _, updateErr := operatorv1helpers.UpdateStatus(c.operatorClient, updateFns...)
+	return updateErr
+}
+
+// syncAPIService wraps ensureAPIService with the per-APIService backoff
+// tracker: while apiService is within its current backoff window, it reuses
+// the last-known failure instead of re-reading status from the aggregator.
+// On success the backoff is reset.
+func (c *APIServiceController) syncAPIService(apiService *apiregistrationv1.APIService) error {
+	now := c.now()
+
+	c.backoffMu.Lock()
+	state := c.backoffOrNil(apiService.Name)
+	if state != nil && now.Sub(state.lastFailure) < nextDelay(state.attempt) {
+		err := &diagnosedError{reason: state.lastReason, message: state.lastMessage}
+		c.backoffMu.Unlock()
+		return err
+	}
+	c.backoffMu.Unlock()
+
+	err := c.ensureAPIService(apiService)
+
+	c.backoffMu.Lock()
+	defer c.backoffMu.Unlock()
+	if err == nil {
+		delete(c.backoffs, apiService.Name)
+		return nil
+	}
+
+	reason, message := "Error", err.Error()
+	if de, ok := err.(*diagnosedError); ok {
+		reason, message = de.reason, de.message
+	}
+	if c.backoffs == nil {
+		c.backoffs = map[string]*apiServiceBackoff{}
+	}
+	state = c.backoffs[apiService.Name]
+	if state == nil {
+		state = &apiServiceBackoff{}
+		c.backoffs[apiService.Name] = state
+	}
+	state.attempt++
+	state.lastFailure = now
+	state.lastReason = reason
+	state.lastMessage = message
+	return err
+}
+
+// backoffOrNil returns the backoff state for name, assuming backoffMu is held.
+func (c *APIServiceController) backoffOrNil(name string) *apiServiceBackoff {
+	if c.backoffs == nil {
+		return nil
+	}
+	return c.backoffs[name]
+}
+
+func (c *APIServiceController) now() time.Time {
+	if c.clock == nil {
+		return time.Now()
+	}
+	return c.clock.Now()
+}
+
+// pruneRetiredAPIServices deletes APIServices this controller previously
+// created (identified by apiServiceOwnerLabel) that apiServiceProvider no
+// longer desires, and stops tracking their backoff state.
+func (c *APIServiceController) pruneRetiredAPIServices(desiredNames sets.String) error {
+	owned, err := c.apiregistrationv1Client.APIServices().List(context.TODO(), metav1.ListOptions{
+		LabelSelector: apiServiceOwnerLabel + "=" + c.name,
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, apiService := range owned.Items {
+		if desiredNames.Has(apiService.Name) {
+			continue
+		}
+		if err := c.apiregistrationv1Client.APIServices().Delete(context.TODO(), apiService.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, err)
+			continue
+		}
+		c.backoffMu.Lock()
+		delete(c.backoffs, apiService.Name)
+		c.backoffMu.Unlock()
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// ensureAPIService makes sure apiService exists and matches the spec
+// apiServiceProvider wants, creating or updating it as necessary, and returns
+// an error describing why it is not available, if it is not.
+func (c *APIServiceController) ensureAPIService(apiService *apiregistrationv1.APIService) error {
+	existing, err := c.apiregistrationv1Client.APIServices().Get(context.TODO(), apiService.Name, metav1.GetOptions{})
+	// observed is the as-served APIService (or, on first creation, the object we
+	// just created from apiService): the one diagnoseAPIService should inspect.
+	// existing may go on to be replaced by the result of a drift-reconciling
+	// Update below, whose Spec.Service only reflects what apiServiceProvider
+	// wants, not what's actually registered with the aggregator.
+	observed := existing
+	if apierrors.IsNotFound(err) {
+		toCreate := apiService.DeepCopy()
+		if toCreate.Labels == nil {
+			toCreate.Labels = map[string]string{}
+		}
+		toCreate.Labels[apiServiceOwnerLabel] = c.name
+		existing, err = c.apiregistrationv1Client.APIServices().Create(context.TODO(), toCreate, metav1.CreateOptions{})
+		observed = existing
+	} else if err == nil {
+		toUpdate, changed := reconcileAPIService(existing, apiService)
+		if toUpdate.Labels == nil {
+			toUpdate.Labels = map[string]string{}
+		}
+		if toUpdate.Labels[apiServiceOwnerLabel] != c.name {
+			toUpdate.Labels[apiServiceOwnerLabel] = c.name
+			changed = true
+		}
+		if changed {
+			existing, err = c.apiregistrationv1Client.APIServices().Update(context.TODO(), toUpdate, metav1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, cond := range existing.Status.Conditions {
+		if cond.Type != apiregistrationv1.Available {
+			continue
+		}
+		if cond.Status != apiregistrationv1.ConditionTrue {
+			reason, diagMessage := c.diagnoseAPIService(observed)
+			return &diagnosedError{
+				reason:  reason,
+				message: fmt.Sprintf("apiservices.apiregistration.k8s.io/%s: not available: %s (%s: %s)", apiService.Name, cond.Message, reason, diagMessage),
+			}
+		}
+	}
+
+	return nil
+}
+
+// reconcileAPIService returns a copy of existing with the fields
+// apiServiceProvider controls (the inject-cabundle annotation,
+// GroupPriorityMinimum, VersionPriority, and the backing ServiceReference)
+// brought in line with desired, and whether anything actually changed. It
+// never touches existing's labels, ResourceVersion, or status.
+func reconcileAPIService(existing, desired *apiregistrationv1.APIService) (*apiregistrationv1.APIService, bool) {
+	changed := false
+
+	updated := existing.DeepCopy()
+
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	if updated.Annotations[apiServiceInjectCABundleAnnotation] != desired.Annotations[apiServiceInjectCABundleAnnotation] {
+		updated.Annotations[apiServiceInjectCABundleAnnotation] = desired.Annotations[apiServiceInjectCABundleAnnotation]
+		changed = true
+	}
+
+	if updated.Spec.GroupPriorityMinimum != desired.Spec.GroupPriorityMinimum {
+		updated.Spec.GroupPriorityMinimum = desired.Spec.GroupPriorityMinimum
+		changed = true
+	}
+	if updated.Spec.VersionPriority != desired.Spec.VersionPriority {
+		updated.Spec.VersionPriority = desired.Spec.VersionPriority
+		changed = true
+	}
+	if !equalServiceReference(updated.Spec.Service, desired.Spec.Service) {
+		updated.Spec.Service = desired.Spec.Service.DeepCopy()
+		changed = true
+	}
+
+	return updated, changed
+}
+
+func equalServiceReference(a, b *apiregistrationv1.ServiceReference) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Namespace != b.Namespace || a.Name != b.Name {
+		return false
+	}
+	if (a.Port == nil) != (b.Port == nil) {
+		return false
+	}
+	return a.Port == nil || *a.Port == *b.Port
+}
+
+// diagnoseAPIService looks past the aggregator's own Available condition
+// message for an unavailable APIService and tries to pin down why: a missing
+// backing Service, a Service with no ready Endpoints, or (if endpoints exist)
+// a TLS/connectivity problem talking to one of them directly. This lets
+// operators and SREs act on a reason instead of guessing from aggregator
+// prose like "failing or missing response from ...".
+func (c *APIServiceController) diagnoseAPIService(apiService *apiregistrationv1.APIService) (reason, message string) {
+	ref := apiService.Spec.Service
+	if ref == nil {
+		return reasonAggregatorProbeFailed, "APIService has no backing Service reference to diagnose"
+	}
+
+	svc, err := c.kubeClient.CoreV1().Services(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return reasonServiceNotFound, fmt.Sprintf("service %s/%s not found", ref.Namespace, ref.Name)
+	}
+	if err != nil {
+		return reasonAggregatorProbeFailed, fmt.Sprintf("unable to get service %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+
+	endpoints, err := c.kubeClient.CoreV1().Endpoints(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return reasonMissingEndpoints, fmt.Sprintf("endpoints for service %s/%s not found, check the openshift-apiserver daemonset rollout", ref.Namespace, ref.Name)
+	}
+	if err != nil {
+		return reasonAggregatorProbeFailed, fmt.Sprintf("unable to get endpoints %s/%s: %v", ref.Namespace, ref.Name, err)
+	}
+
+	address := firstEndpointAddress(endpoints)
+	if address == "" {
+		return reasonMissingEndpoints, fmt.Sprintf("service %s/%s has no ready endpoint addresses (selector %s), check the openshift-apiserver daemonset rollout", ref.Namespace, ref.Name, labels.SelectorFromSet(svc.Spec.Selector))
+	}
+
+	if c.dialEndpoint == nil {
+		return reasonAggregatorProbeFailed, "endpoints look healthy; the aggregator has not reported success yet"
+	}
+	if err := c.dialEndpoint(address, apiService.Spec.CABundle); err != nil {
+		return classifyDialError(err)
+	}
+
+	return reasonAggregatorProbeFailed, "endpoints look healthy; the aggregator has not reported success yet"
+}
+
+func firstEndpointAddress(endpoints *corev1.Endpoints) string {
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) == 0 || len(subset.Ports) == 0 {
+			continue
+		}
+		return net.JoinHostPort(subset.Addresses[0].IP, fmt.Sprintf("%d", subset.Ports[0].Port))
+	}
+	return ""
+}
+
+// dialTLSEndpoint is the production implementation of
+// APIServiceController.dialEndpoint: it dials address and performs a TLS
+// handshake using caBundle to verify the server certificate.
+func dialTLSEndpoint(address string, caBundle []byte) error {
+	pool := x509.NewCertPool()
+	if len(caBundle) > 0 {
+		pool.AppendCertsFromPEM(caBundle)
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", address, &tls.Config{RootCAs: pool})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return nil
+}
+
+func classifyDialError(err error) (reason, message string) {
+	var certErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &certInvalidErr) {
+		return reasonTLSHandshakeFailed, err.Error()
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Timeout() {
+			return reasonAggregatorProbeFailed, err.Error()
+		}
+		return reasonConnectionRefused, err.Error()
+	}
+
+	return reasonAggregatorProbeFailed, err.Error()
+}
+
+// aggregateReason picks a single machine-readable Reason for the
+// APIServicesAvailable condition: the shared diagnosedError reason when every
+// failure agrees, or the generic "Error" when the failures are a mix (e.g. a
+// transport error alongside a diagnosed unavailability).
+func aggregateReason(errs []error) string {
+	reason := ""
+	for _, err := range errs {
+		de, ok := err.(*diagnosedError)
+		if !ok {
+			return "Error"
+		}
+		if reason == "" {
+			reason = de.reason
+		} else if reason != de.reason {
+			return "Error"
+		}
+	}
+	if reason == "" {
+		return "Error"
+	}
+	return reason
+}
@@ -1,19 +1,26 @@
 package apiservicecontroller
 
 import (
+	"context"
+	"crypto/x509"
+	"fmt"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	operatorv1 "github.com/openshift/api/operator/v1"
 	"github.com/openshift/cluster-openshift-apiserver-operator/pkg/operator/operatorclient"
 	"github.com/openshift/library-go/pkg/operator/events"
-	"github.com/openshift/library-go/pkg/operator/status"
 	operatorv1helpers "github.com/openshift/library-go/pkg/operator/v1helpers"
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
 	"k8s.io/apimachinery/pkg/util/diff"
 	"k8s.io/client-go/kubernetes/fake"
 	kubetesting "k8s.io/client-go/testing"
@@ -29,6 +36,8 @@ func TestAvailableStatus(t *testing.T) {
 		expectedReasons     []string
 		expectedMessages    []string
 		existingAPIServices []runtime.Object
+		existingKubeObjects []runtime.Object
+		dialEndpoint        func(address string, caBundle []byte) error
 		apiServiceReactor   kubetesting.ReactionFunc
 		daemonReactor       kubetesting.ReactionFunc
 	}{
@@ -70,10 +79,12 @@ func TestAvailableStatus(t *testing.T) {
 			},
 		},
 		{
-			name:             "APIServiceNotAvailable",
-			expectedStatus:   operatorv1.ConditionFalse,
-			expectedReasons:  []string{"Error"},
-			expectedMessages: []string{"apiservices.apiregistration.k8s.io/v1.build.openshift.io: not available: TEST MESSAGE"},
+			name:            "APIServiceNotAvailable",
+			expectedStatus:  operatorv1.ConditionFalse,
+			expectedReasons: []string{reasonServiceNotFound},
+			expectedMessages: []string{
+				fmt.Sprintf("apiservices.apiregistration.k8s.io/v1.build.openshift.io: not available: TEST MESSAGE (%s: service %s/api not found)", reasonServiceNotFound, operatorclient.TargetNamespace),
+			},
 
 			existingAPIServices: []runtime.Object{
 				runtime.Object(newAPIService("build.openshift.io", "v1")),
@@ -103,10 +114,10 @@ func TestAvailableStatus(t *testing.T) {
 		{
 			name:            "MultipleAPIServiceNotAvailable",
 			expectedStatus:  operatorv1.ConditionFalse,
-			expectedReasons: []string{"Error"},
+			expectedReasons: []string{reasonServiceNotFound},
 			expectedMessages: []string{
-				"apiservices.apiregistration.k8s.io/v1.apps.openshift.io: not available: TEST MESSAGE",
-				"apiservices.apiregistration.k8s.io/v1.build.openshift.io: not available: TEST MESSAGE",
+				fmt.Sprintf("apiservices.apiregistration.k8s.io/v1.apps.openshift.io: not available: TEST MESSAGE (%s: service %s/api not found)", reasonServiceNotFound, operatorclient.TargetNamespace),
+				fmt.Sprintf("apiservices.apiregistration.k8s.io/v1.build.openshift.io: not available: TEST MESSAGE (%s: service %s/api not found)", reasonServiceNotFound, operatorclient.TargetNamespace),
 			},
 
 			existingAPIServices: []runtime.Object{
@@ -142,12 +153,97 @@ func TestAvailableStatus(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:            "APIServiceNotAvailableMissingEndpoints",
+			expectedStatus:  operatorv1.ConditionFalse,
+			expectedReasons: []string{reasonMissingEndpoints},
+			expectedMessages: []string{
+				fmt.Sprintf("apiservices.apiregistration.k8s.io/v1.build.openshift.io: not available: TEST MESSAGE (%s: service %s/api has no ready endpoint addresses (selector ), check the openshift-apiserver daemonset rollout)", reasonMissingEndpoints, operatorclient.TargetNamespace),
+			},
+
+			existingAPIServices: []runtime.Object{
+				runtime.Object(newAPIService("build.openshift.io", "v1")),
+				runtime.Object(newAPIService("apps.openshift.io", "v1")),
+			},
+			existingKubeObjects: []runtime.Object{
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: operatorclient.TargetNamespace, Name: "api"}},
+				&corev1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: operatorclient.TargetNamespace, Name: "api"}},
+			},
+			apiServiceReactor: func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+				if action.GetVerb() == "get" && action.(kubetesting.GetAction).GetName() == "v1.build.openshift.io" {
+					return true, &apiregistrationv1.APIService{
+						ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io", Annotations: map[string]string{"service.alpha.openshift.io/inject-cabundle": "true"}},
+						Spec: apiregistrationv1.APIServiceSpec{
+							Group:                "build.openshift.io",
+							Version:              "v1",
+							Service:              &apiregistrationv1.ServiceReference{Namespace: operatorclient.TargetNamespace, Name: "api"},
+							GroupPriorityMinimum: 9900,
+							VersionPriority:      15,
+						},
+						Status: apiregistrationv1.APIServiceStatus{
+							Conditions: []apiregistrationv1.APIServiceCondition{
+								{Type: apiregistrationv1.Available, Status: apiregistrationv1.ConditionFalse, Message: "TEST MESSAGE"},
+							},
+						},
+					}, nil
+				}
+				return false, nil, nil
+			},
+		},
+		{
+			name:            "APIServiceNotAvailableTLSHandshakeFailed",
+			expectedStatus:  operatorv1.ConditionFalse,
+			expectedReasons: []string{reasonTLSHandshakeFailed},
+			expectedMessages: []string{
+				fmt.Sprintf("apiservices.apiregistration.k8s.io/v1.build.openshift.io: not available: TEST MESSAGE (%s: x509: certificate signed by unknown authority)", reasonTLSHandshakeFailed),
+			},
+
+			existingAPIServices: []runtime.Object{
+				runtime.Object(newAPIService("build.openshift.io", "v1")),
+				runtime.Object(newAPIService("apps.openshift.io", "v1")),
+			},
+			existingKubeObjects: []runtime.Object{
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: operatorclient.TargetNamespace, Name: "api"}},
+				&corev1.Endpoints{
+					ObjectMeta: metav1.ObjectMeta{Namespace: operatorclient.TargetNamespace, Name: "api"},
+					Subsets: []corev1.EndpointSubset{
+						{
+							Addresses: []corev1.EndpointAddress{{IP: "10.0.0.1"}},
+							Ports:     []corev1.EndpointPort{{Port: 443}},
+						},
+					},
+				},
+			},
+			dialEndpoint: func(address string, caBundle []byte) error {
+				return x509.UnknownAuthorityError{}
+			},
+			apiServiceReactor: func(action kubetesting.Action) (handled bool, ret runtime.Object, err error) {
+				if action.GetVerb() == "get" && action.(kubetesting.GetAction).GetName() == "v1.build.openshift.io" {
+					return true, &apiregistrationv1.APIService{
+						ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io", Annotations: map[string]string{"service.alpha.openshift.io/inject-cabundle": "true"}},
+						Spec: apiregistrationv1.APIServiceSpec{
+							Group:                "build.openshift.io",
+							Version:              "v1",
+							Service:              &apiregistrationv1.ServiceReference{Namespace: operatorclient.TargetNamespace, Name: "api"},
+							GroupPriorityMinimum: 9900,
+							VersionPriority:      15,
+						},
+						Status: apiregistrationv1.APIServiceStatus{
+							Conditions: []apiregistrationv1.APIServiceCondition{
+								{Type: apiregistrationv1.Available, Status: apiregistrationv1.ConditionFalse, Message: "TEST MESSAGE"},
+							},
+						},
+					}, nil
+				}
+				return false, nil, nil
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 
-			kubeClient := fake.NewSimpleClientset()
+			kubeClient := fake.NewSimpleClientset(tc.existingKubeObjects...)
 			kubeAggregatorClient := kubeaggregatorfake.NewSimpleClientset(tc.existingAPIServices...)
 			if tc.apiServiceReactor != nil {
 				kubeAggregatorClient.PrependReactor("*", "apiservices", tc.apiServiceReactor)
@@ -155,22 +251,27 @@ func TestAvailableStatus(t *testing.T) {
 
 			fakeOperatorClient := operatorv1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed}, &operatorv1.OperatorStatus{}, nil)
 			operator := &APIServiceController{
-				apiServices: []*apiregistrationv1.APIService{
+				name: "TestAvailableStatus",
+				apiServiceProvider: NewStaticProvider([]APIServiceDescriptor{
 					{
-						ObjectMeta: metav1.ObjectMeta{Name: "v1.apps.openshift.io"},
-						Spec:       apiregistrationv1.APIServiceSpec{Group: "apps.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+						APIService: &apiregistrationv1.APIService{
+							ObjectMeta: metav1.ObjectMeta{Name: "v1.apps.openshift.io"},
+							Spec:       apiregistrationv1.APIServiceSpec{Group: "apps.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+						},
 					},
 					{
-						ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io"},
-						Spec:       apiregistrationv1.APIServiceSpec{Group: "build.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+						APIService: &apiregistrationv1.APIService{
+							ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io"},
+							Spec:       apiregistrationv1.APIServiceSpec{Group: "build.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+						},
 					},
-				},
+				}),
 				precondition:            func() (bool, error) { return true, nil },
 				kubeClient:              kubeClient,
 				eventRecorder:           events.NewInMemoryRecorder(""),
 				operatorClient:          fakeOperatorClient,
 				apiregistrationv1Client: kubeAggregatorClient.ApiregistrationV1(),
-				versionRecorder:         status.NewVersionGetter(),
+				dialEndpoint:            tc.dialEndpoint,
 			}
 
 			_ = operator.sync()
@@ -207,6 +308,351 @@ func TestAvailableStatus(t *testing.T) {
 
 }
 
+func TestAvailableStatusMixedOwnership(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+	kubeAggregatorClient := kubeaggregatorfake.NewSimpleClientset(
+		runtime.Object(newAPIService("apps.openshift.io", "v1")),
+	)
+
+	fakeOperatorClient := operatorv1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed}, &operatorv1.OperatorStatus{}, nil)
+	operator := &APIServiceController{
+		name: "TestAvailableStatusMixedOwnership",
+		apiServiceProvider: NewStaticProvider([]APIServiceDescriptor{
+			{
+				APIService: &apiregistrationv1.APIService{
+					ObjectMeta: metav1.ObjectMeta{Name: "v1.apps.openshift.io"},
+					Spec:       apiregistrationv1.APIServiceSpec{Group: "apps.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+				},
+			},
+			{
+				APIService: &apiregistrationv1.APIService{
+					ObjectMeta: metav1.ObjectMeta{Name: "v1.oauth.openshift.io"},
+					Spec:       apiregistrationv1.APIServiceSpec{Group: "oauth.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+				},
+				Owned:              func(ctx context.Context) (bool, error) { return false, nil },
+				OwnedConditionType: "ManagingOpenShiftOAuthAPIServer",
+			},
+		}),
+		precondition:            func() (bool, error) { return true, nil },
+		kubeClient:              kubeClient,
+		eventRecorder:           events.NewInMemoryRecorder(""),
+		operatorClient:          fakeOperatorClient,
+		apiregistrationv1Client: kubeAggregatorClient.ApiregistrationV1(),
+	}
+
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kubeAggregatorClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.oauth.openshift.io", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the handed-off APIService not to be created, got err: %v", err)
+	}
+
+	_, resultStatus, _, err := fakeOperatorClient.GetOperatorState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	available := operatorv1helpers.FindOperatorCondition(resultStatus.Conditions, "APIServicesAvailable")
+	if available == nil {
+		t.Fatal("APIServicesAvailable condition not found")
+	}
+	if available.Status != operatorv1.ConditionTrue {
+		t.Error(diff.ObjectGoPrintSideBySide(available.Status, operatorv1.ConditionTrue))
+	}
+
+	managing := operatorv1helpers.FindOperatorCondition(resultStatus.Conditions, "ManagingOpenShiftOAuthAPIServer")
+	if managing == nil {
+		t.Fatal("ManagingOpenShiftOAuthAPIServer condition not found")
+	}
+	if managing.Status != operatorv1.ConditionFalse {
+		t.Error(diff.ObjectGoPrintSideBySide(managing.Status, operatorv1.ConditionFalse))
+	}
+}
+
+func TestAPIServiceBackoffSkipsAggregatorWhileFlapping(t *testing.T) {
+	var getCalls int32
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeAggregatorClient := kubeaggregatorfake.NewSimpleClientset(
+		runtime.Object(newAPIService("build.openshift.io", "v1")),
+	)
+	kubeAggregatorClient.PrependReactor("get", "apiservices", func(action kubetesting.Action) (bool, runtime.Object, error) {
+		atomic.AddInt32(&getCalls, 1)
+		return true, &apiregistrationv1.APIService{
+			ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io"},
+			Spec: apiregistrationv1.APIServiceSpec{
+				Group:   "build.openshift.io",
+				Version: "v1",
+				Service: &apiregistrationv1.ServiceReference{Namespace: operatorclient.TargetNamespace, Name: "api"},
+			},
+			Status: apiregistrationv1.APIServiceStatus{
+				Conditions: []apiregistrationv1.APIServiceCondition{
+					{Type: apiregistrationv1.Available, Status: apiregistrationv1.ConditionFalse, Message: "TEST MESSAGE"},
+				},
+			},
+		}, nil
+	})
+
+	fakeOperatorClient := operatorv1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed}, &operatorv1.OperatorStatus{}, nil)
+	operator := &APIServiceController{
+		name: "TestAPIServiceBackoffSkipsAggregatorWhileFlapping",
+		apiServiceProvider: NewStaticProvider([]APIServiceDescriptor{
+			{
+				APIService: &apiregistrationv1.APIService{
+					ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io"},
+					Spec:       apiregistrationv1.APIServiceSpec{Group: "build.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+				},
+			},
+		}),
+		precondition:            func() (bool, error) { return true, nil },
+		kubeClient:              kubeClient,
+		eventRecorder:           events.NewInMemoryRecorder(""),
+		operatorClient:          fakeOperatorClient,
+		apiregistrationv1Client: kubeAggregatorClient.ApiregistrationV1(),
+		clock:                   clock.NewFakeClock(time.Now()),
+		backoffs:                map[string]*apiServiceBackoff{},
+	}
+
+	// Two syncs in quick succession: the first observes the failure and starts
+	// the backoff window, the second should reuse it without touching the
+	// aggregator client.
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := atomic.LoadInt32(&getCalls); calls != 1 {
+		t.Errorf("expected exactly 1 aggregator Get while backing off, got %d", calls)
+	}
+
+	_, resultStatus, _, err := fakeOperatorClient.GetOperatorState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition := operatorv1helpers.FindOperatorCondition(resultStatus.Conditions, "APIServicesAvailable")
+	if condition == nil {
+		t.Fatal("APIServicesAvailable condition not found")
+	}
+	if condition.Status != operatorv1.ConditionFalse {
+		t.Error(diff.ObjectGoPrintSideBySide(condition.Status, operatorv1.ConditionFalse))
+	}
+	if condition.Reason != reasonServiceNotFound {
+		t.Error(diff.ObjectGoPrintSideBySide(condition.Reason, reasonServiceNotFound))
+	}
+}
+
+func TestAPIServiceProviderReconcilesAdditionsAndRemovals(t *testing.T) {
+	const controllerName = "TestAPIServiceProviderReconcilesAdditionsAndRemovals"
+
+	existingApps := newAPIService("apps.openshift.io", "v1")
+	existingApps.Labels = map[string]string{apiServiceOwnerLabel: controllerName}
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeAggregatorClient := kubeaggregatorfake.NewSimpleClientset(runtime.Object(existingApps))
+
+	fakeOperatorClient := operatorv1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed}, &operatorv1.OperatorStatus{}, nil)
+	operator := &APIServiceController{
+		name: controllerName,
+		apiServiceProvider: NewStaticProvider([]APIServiceDescriptor{
+			{
+				APIService: &apiregistrationv1.APIService{
+					ObjectMeta: metav1.ObjectMeta{Name: "v1.apps.openshift.io"},
+					Spec:       apiregistrationv1.APIServiceSpec{Group: "apps.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+				},
+			},
+		}),
+		precondition:            func() (bool, error) { return true, nil },
+		kubeClient:              kubeClient,
+		eventRecorder:           events.NewInMemoryRecorder(""),
+		operatorClient:          fakeOperatorClient,
+		apiregistrationv1Client: kubeAggregatorClient.ApiregistrationV1(),
+	}
+
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The desired set changes between syncs: apps.openshift.io is retired,
+	// build.openshift.io is newly desired.
+	operator.apiServiceProvider = NewStaticProvider([]APIServiceDescriptor{
+		{
+			APIService: &apiregistrationv1.APIService{
+				ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io"},
+				Spec:       apiregistrationv1.APIServiceSpec{Group: "build.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+			},
+		},
+	})
+
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := kubeAggregatorClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.build.openshift.io", metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the newly-desired APIService to be created, got err: %v", err)
+	}
+	if _, err := kubeAggregatorClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.apps.openshift.io", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the retired APIService to be deleted, got err: %v", err)
+	}
+}
+
+func TestAPIServiceReconcilesSpecDrift(t *testing.T) {
+	const controllerName = "TestAPIServiceReconcilesSpecDrift"
+
+	existing := newAPIService("apps.openshift.io", "v1")
+	existing.Labels = map[string]string{apiServiceOwnerLabel: controllerName}
+	existing.Annotations["service.alpha.openshift.io/inject-cabundle"] = "false"
+	existing.Spec.GroupPriorityMinimum = 1000
+	existing.Spec.VersionPriority = 1
+	existing.Spec.Service = &apiregistrationv1.ServiceReference{Namespace: "some-other-namespace", Name: "some-other-service"}
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeAggregatorClient := kubeaggregatorfake.NewSimpleClientset(runtime.Object(existing))
+
+	fakeOperatorClient := operatorv1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed}, &operatorv1.OperatorStatus{}, nil)
+	operator := &APIServiceController{
+		name: controllerName,
+		apiServiceProvider: NewStaticProvider([]APIServiceDescriptor{
+			{APIService: newAPIService("apps.openshift.io", "v1")},
+		}),
+		precondition:            func() (bool, error) { return true, nil },
+		kubeClient:              kubeClient,
+		eventRecorder:           events.NewInMemoryRecorder(""),
+		operatorClient:          fakeOperatorClient,
+		apiregistrationv1Client: kubeAggregatorClient.ApiregistrationV1(),
+	}
+
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	reconciled, err := kubeAggregatorClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.apps.openshift.io", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reconciled.Annotations["service.alpha.openshift.io/inject-cabundle"] != "true" {
+		t.Errorf("expected inject-cabundle annotation to be reconciled to true, got %q", reconciled.Annotations["service.alpha.openshift.io/inject-cabundle"])
+	}
+	if reconciled.Spec.GroupPriorityMinimum != 9900 {
+		t.Errorf("expected GroupPriorityMinimum to be reconciled to 9900, got %d", reconciled.Spec.GroupPriorityMinimum)
+	}
+	if reconciled.Spec.VersionPriority != 15 {
+		t.Errorf("expected VersionPriority to be reconciled to 15, got %d", reconciled.Spec.VersionPriority)
+	}
+	if reconciled.Spec.Service.Namespace != operatorclient.TargetNamespace || reconciled.Spec.Service.Name != "api" {
+		t.Errorf("expected ServiceReference to be reconciled to %s/api, got %s/%s", operatorclient.TargetNamespace, reconciled.Spec.Service.Namespace, reconciled.Spec.Service.Name)
+	}
+	if reconciled.Labels[apiServiceOwnerLabel] != controllerName {
+		t.Errorf("expected existing owner label to be preserved, got %q", reconciled.Labels[apiServiceOwnerLabel])
+	}
+}
+
+// TestAPIServiceDiagnosesObservedStateDespiteSpecDrift guards against
+// diagnoseAPIService being handed the post-reconcile object instead of the
+// one actually observed from the aggregator: reconcileAPIService overwrites
+// Spec.Service with whatever apiServiceProvider wants, which has nothing to
+// do with where the existing, unavailable APIService's backing Service
+// really lives.
+func TestAPIServiceDiagnosesObservedStateDespiteSpecDrift(t *testing.T) {
+	const controllerName = "TestAPIServiceDiagnosesObservedStateDespiteSpecDrift"
+
+	existing := newAPIService("build.openshift.io", "v1")
+	existing.Status.Conditions = []apiregistrationv1.APIServiceCondition{
+		{Type: apiregistrationv1.Available, Status: apiregistrationv1.ConditionFalse, Message: "TEST MESSAGE"},
+	}
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeAggregatorClient := kubeaggregatorfake.NewSimpleClientset(runtime.Object(existing))
+
+	fakeOperatorClient := operatorv1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed}, &operatorv1.OperatorStatus{}, nil)
+	operator := &APIServiceController{
+		name: controllerName,
+		apiServiceProvider: NewStaticProvider([]APIServiceDescriptor{
+			{
+				APIService: &apiregistrationv1.APIService{
+					ObjectMeta: metav1.ObjectMeta{Name: "v1.build.openshift.io"},
+					// Deliberately drifted from the observed APIService's real
+					// Service reference, to force ensureAPIService to reconcile.
+					Spec: apiregistrationv1.APIServiceSpec{Group: "build.openshift.io", Version: "v1", Service: &apiregistrationv1.ServiceReference{}},
+				},
+			},
+		}),
+		precondition:            func() (bool, error) { return true, nil },
+		kubeClient:              kubeClient,
+		eventRecorder:           events.NewInMemoryRecorder(""),
+		operatorClient:          fakeOperatorClient,
+		apiregistrationv1Client: kubeAggregatorClient.ApiregistrationV1(),
+	}
+
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, resultStatus, _, err := fakeOperatorClient.GetOperatorState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition := operatorv1helpers.FindOperatorCondition(resultStatus.Conditions, "APIServicesAvailable")
+	if condition == nil {
+		t.Fatal("APIServicesAvailable condition not found")
+	}
+
+	expectedMessage := fmt.Sprintf("apiservices.apiregistration.k8s.io/v1.build.openshift.io: not available: TEST MESSAGE (%s: service %s/api not found)", reasonServiceNotFound, operatorclient.TargetNamespace)
+	if condition.Message != expectedMessage {
+		t.Errorf("expected diagnose to reflect the observed Service reference %s/api, got message %q", operatorclient.TargetNamespace, condition.Message)
+	}
+}
+
+func TestAPIServiceLabelsPreExistingAPIServiceForOwnership(t *testing.T) {
+	const controllerName = "TestAPIServiceLabelsPreExistingAPIServiceForOwnership"
+
+	// Simulate an APIService created by a prior operator version that never
+	// stamped the ownership label.
+	existing := newAPIService("apps.openshift.io", "v1")
+	existing.Labels = nil
+
+	kubeClient := fake.NewSimpleClientset()
+	kubeAggregatorClient := kubeaggregatorfake.NewSimpleClientset(runtime.Object(existing))
+
+	fakeOperatorClient := operatorv1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed}, &operatorv1.OperatorStatus{}, nil)
+	operator := &APIServiceController{
+		name: controllerName,
+		apiServiceProvider: NewStaticProvider([]APIServiceDescriptor{
+			{APIService: newAPIService("apps.openshift.io", "v1")},
+		}),
+		precondition:            func() (bool, error) { return true, nil },
+		kubeClient:              kubeClient,
+		eventRecorder:           events.NewInMemoryRecorder(""),
+		operatorClient:          fakeOperatorClient,
+		apiregistrationv1Client: kubeAggregatorClient.ApiregistrationV1(),
+	}
+
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	labeled, err := kubeAggregatorClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.apps.openshift.io", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labeled.Labels[apiServiceOwnerLabel] != controllerName {
+		t.Fatalf("expected pre-existing APIService to be labeled with owner %q, got %q", controllerName, labeled.Labels[apiServiceOwnerLabel])
+	}
+
+	// Now that it's labeled, dropping it from the desired set must prune it,
+	// the same as one this controller created itself.
+	operator.apiServiceProvider = NewStaticProvider(nil)
+	if err := operator.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeAggregatorClient.ApiregistrationV1().APIServices().Get(context.TODO(), "v1.apps.openshift.io", metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the now-labeled APIService to be prunable, got err: %v", err)
+	}
+}
+
 func newAPIService(group, version string) *apiregistrationv1.APIService {
 	return &apiregistrationv1.APIService{
 		ObjectMeta: metav1.ObjectMeta{Name: version + "." + group, Annotations: map[string]string{"service.alpha.openshift.io/inject-cabundle": "true"}},
@@ -0,0 +1,177 @@
+package apiservicecontroller
+
+import (
+	"context"
+
+	configv1 "github.com/openshift/api/config/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiregistrationv1 "k8s.io/kube-aggregator/pkg/apis/apiregistration/v1"
+)
+
+// apiServiceInjectCABundleAnnotation marks an APIService for CA-bundle
+// injection by the service-ca operator, the same annotation newAPIService has
+// always set.
+const apiServiceInjectCABundleAnnotation = "service.alpha.openshift.io/inject-cabundle"
+
+// APIServiceSetProvider supplies the set of APIServices this operator should
+// currently be managing. It is consulted at the start of every sync, so the
+// set it returns can change as FeatureGates or other cluster state changes
+// without requiring a restart.
+type APIServiceSetProvider interface {
+	DesiredAPIServices(ctx context.Context) ([]APIServiceDescriptor, error)
+}
+
+// StaticProvider returns a fixed set of APIServiceDescriptors. It is the
+// provider used by tests, and by callers that don't need the set to vary with
+// FeatureGates.
+type StaticProvider struct {
+	apiServices []APIServiceDescriptor
+}
+
+// NewStaticProvider returns an APIServiceSetProvider that always returns
+// apiServices.
+func NewStaticProvider(apiServices []APIServiceDescriptor) *StaticProvider {
+	return &StaticProvider{apiServices: apiServices}
+}
+
+func (p *StaticProvider) DesiredAPIServices(ctx context.Context) ([]APIServiceDescriptor, error) {
+	return p.apiServices, nil
+}
+
+// featureGatedAPIService is one row of the declarative table FeatureGatedProvider
+// evaluates on every sync: an APIService to apply, optionally gated behind a
+// FeatureGate name.
+type featureGatedAPIService struct {
+	group                string
+	version              string
+	groupPriorityMinimum int32
+	versionPriority      int32
+
+	// requiredFeatureGate, if non-empty, must be enabled in the cluster
+	// FeatureGate for this APIService to be included. Empty means "always".
+	requiredFeatureGate configv1.FeatureGateName
+
+	// ownedConditionType, if non-empty, is set as the descriptor's
+	// OwnedConditionType. The row carries no ownership predicate, so the
+	// controller always publishes this condition as True.
+	ownedConditionType string
+}
+
+const (
+	// featureGateQuotaOpenShiftAPI gates quota.openshift.io/v1, which is only
+	// wired up for clusters that have opted into cluster resource quota ahead
+	// of its general availability.
+	featureGateQuotaOpenShiftAPI configv1.FeatureGateName = "QuotaOpenShiftAPI"
+
+	// featureGateTemplateOpenShiftAPI gates template.openshift.io/v1, which
+	// some clusters disable entirely once they've migrated off templates.
+	featureGateTemplateOpenShiftAPI configv1.FeatureGateName = "TemplateOpenShiftAPI"
+)
+
+// apiServiceOAuthOwnedCondition is the ownership condition published for
+// oauth.openshift.io/v1. FeatureGatedProvider sets no Owned predicate for it,
+// so through this provider the condition is always True and the APIService is
+// never treated as handed off.
+const apiServiceOAuthOwnedCondition = "ManagingOpenShiftOAuthAPIServer"
+
+// featureGatedAPIServiceTable is the full set of APIServices this operator
+// knows how to manage, and the FeatureGate (if any) that must be enabled for
+// each. New OpenShift APIs land here instead of as a literal slice, so the set
+// tracks FeatureSet changes across releases without a code change.
+var featureGatedAPIServiceTable = []featureGatedAPIService{
+	{group: "apps.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15},
+	{group: "build.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15},
+	{group: "image.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15},
+	{group: "project.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15},
+	{group: "quota.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15, requiredFeatureGate: featureGateQuotaOpenShiftAPI},
+	{group: "route.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15},
+	{group: "security.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15},
+	{group: "template.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15, requiredFeatureGate: featureGateTemplateOpenShiftAPI},
+	{group: "oauth.openshift.io", version: "v1", groupPriorityMinimum: 9900, versionPriority: 15, ownedConditionType: apiServiceOAuthOwnedCondition},
+}
+
+// FeatureGatedProvider derives the desired APIService set from the cluster's
+// config.openshift.io/v1 FeatureGate resource plus featureGatedAPIServiceTable,
+// instead of a hard-coded list, so APIs that are still feature-gated are added
+// and removed as the cluster's FeatureSet changes. Rows without a FeatureGate,
+// including oauth.openshift.io, are always included.
+type FeatureGatedProvider struct {
+	featureGateLister configv1listers.FeatureGateLister
+	serviceName       string
+	serviceNamespace  string
+}
+
+// NewFeatureGatedProvider returns an APIServiceSetProvider backed by the
+// cluster FeatureGate. serviceName/serviceNamespace identify the aggregated
+// apiserver Service every generated APIService points at.
+func NewFeatureGatedProvider(featureGateLister configv1listers.FeatureGateLister, serviceNamespace, serviceName string) *FeatureGatedProvider {
+	return &FeatureGatedProvider{
+		featureGateLister: featureGateLister,
+		serviceName:       serviceName,
+		serviceNamespace:  serviceNamespace,
+	}
+}
+
+func (p *FeatureGatedProvider) DesiredAPIServices(ctx context.Context) ([]APIServiceDescriptor, error) {
+	enabled, err := p.enabledFeatureGates()
+	if err != nil {
+		return nil, err
+	}
+
+	var desired []APIServiceDescriptor
+	for _, spec := range featureGatedAPIServiceTable {
+		if spec.requiredFeatureGate != "" && !enabled[spec.requiredFeatureGate] {
+			continue
+		}
+		desired = append(desired, APIServiceDescriptor{
+			APIService:         p.newAPIService(spec),
+			OwnedConditionType: spec.ownedConditionType,
+		})
+	}
+	return desired, nil
+}
+
+func (p *FeatureGatedProvider) newAPIService(spec featureGatedAPIService) *apiregistrationv1.APIService {
+	name := spec.version + "." + spec.group
+	return &apiregistrationv1.APIService{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: map[string]string{apiServiceInjectCABundleAnnotation: "true"},
+		},
+		Spec: apiregistrationv1.APIServiceSpec{
+			Group:                spec.group,
+			Version:              spec.version,
+			Service:              &apiregistrationv1.ServiceReference{Namespace: p.serviceNamespace, Name: p.serviceName},
+			GroupPriorityMinimum: spec.groupPriorityMinimum,
+			VersionPriority:      spec.versionPriority,
+		},
+	}
+}
+
+// enabledFeatureGates resolves the cluster FeatureGate into the set of
+// FeatureGate names currently enabled, combining the selected FeatureSet's
+// defaults with any CustomNoUpgrade overrides.
+func (p *FeatureGatedProvider) enabledFeatureGates() (map[configv1.FeatureGateName]bool, error) {
+	featureGate, err := p.featureGateLister.Get("cluster")
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := map[configv1.FeatureGateName]bool{}
+	if featureSet, ok := configv1.FeatureSets[featureGate.Spec.FeatureSet]; ok {
+		for _, feature := range featureSet.Enabled {
+			enabled[feature.FeatureGateAttributes.Name] = true
+		}
+	}
+	if featureGate.Spec.FeatureSet == configv1.CustomNoUpgrade && featureGate.Spec.CustomNoUpgrade != nil {
+		for _, name := range featureGate.Spec.CustomNoUpgrade.Enabled {
+			enabled[name] = true
+		}
+		for _, name := range featureGate.Spec.CustomNoUpgrade.Disabled {
+			delete(enabled, name)
+		}
+	}
+	return enabled, nil
+}
@@ -0,0 +1,171 @@
+package apiservicecontroller
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	configv1 "github.com/openshift/api/config/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newFeatureGateLister(t *testing.T, featureGate *configv1.FeatureGate) configv1listers.FeatureGateLister {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(featureGate); err != nil {
+		t.Fatalf("failed to seed FeatureGate lister: %v", err)
+	}
+	return configv1listers.NewFeatureGateLister(indexer)
+}
+
+func apiServiceNames(descriptors []APIServiceDescriptor) []string {
+	names := make([]string, 0, len(descriptors))
+	for _, desc := range descriptors {
+		names = append(names, desc.APIService.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFeatureGatedProviderDesiredAPIServices(t *testing.T) {
+	testCases := []struct {
+		name          string
+		featureGate   *configv1.FeatureGate
+		expectedNames []string
+	}{
+		{
+			name: "DefaultFeatureSet",
+			featureGate: &configv1.FeatureGate{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+			},
+			expectedNames: []string{
+				"v1.apps.openshift.io",
+				"v1.build.openshift.io",
+				"v1.image.openshift.io",
+				"v1.oauth.openshift.io",
+				"v1.project.openshift.io",
+				"v1.route.openshift.io",
+				"v1.security.openshift.io",
+			},
+		},
+		{
+			name: "CustomNoUpgradeEnablesQuota",
+			featureGate: &configv1.FeatureGate{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Spec: configv1.FeatureGateSpec{
+					FeatureGateSelection: configv1.FeatureGateSelection{
+						FeatureSet: configv1.CustomNoUpgrade,
+						CustomNoUpgrade: &configv1.CustomFeatureGates{
+							Enabled: []configv1.FeatureGateName{featureGateQuotaOpenShiftAPI},
+						},
+					},
+				},
+			},
+			expectedNames: []string{
+				"v1.apps.openshift.io",
+				"v1.build.openshift.io",
+				"v1.image.openshift.io",
+				"v1.oauth.openshift.io",
+				"v1.project.openshift.io",
+				"v1.quota.openshift.io",
+				"v1.route.openshift.io",
+				"v1.security.openshift.io",
+			},
+		},
+		{
+			name: "CustomNoUpgradeEnablesBothGatedAPIs",
+			featureGate: &configv1.FeatureGate{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Spec: configv1.FeatureGateSpec{
+					FeatureGateSelection: configv1.FeatureGateSelection{
+						FeatureSet: configv1.CustomNoUpgrade,
+						CustomNoUpgrade: &configv1.CustomFeatureGates{
+							Enabled: []configv1.FeatureGateName{featureGateQuotaOpenShiftAPI, featureGateTemplateOpenShiftAPI},
+						},
+					},
+				},
+			},
+			expectedNames: []string{
+				"v1.apps.openshift.io",
+				"v1.build.openshift.io",
+				"v1.image.openshift.io",
+				"v1.oauth.openshift.io",
+				"v1.project.openshift.io",
+				"v1.quota.openshift.io",
+				"v1.route.openshift.io",
+				"v1.security.openshift.io",
+				"v1.template.openshift.io",
+			},
+		},
+		{
+			name: "CustomNoUpgradeDisabledOverridesEnabled",
+			featureGate: &configv1.FeatureGate{
+				ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+				Spec: configv1.FeatureGateSpec{
+					FeatureGateSelection: configv1.FeatureGateSelection{
+						FeatureSet: configv1.CustomNoUpgrade,
+						CustomNoUpgrade: &configv1.CustomFeatureGates{
+							Enabled:  []configv1.FeatureGateName{featureGateQuotaOpenShiftAPI},
+							Disabled: []configv1.FeatureGateName{featureGateQuotaOpenShiftAPI},
+						},
+					},
+				},
+			},
+			expectedNames: []string{
+				"v1.apps.openshift.io",
+				"v1.build.openshift.io",
+				"v1.image.openshift.io",
+				"v1.oauth.openshift.io",
+				"v1.project.openshift.io",
+				"v1.route.openshift.io",
+				"v1.security.openshift.io",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider := NewFeatureGatedProvider(newFeatureGateLister(t, tc.featureGate), "openshift-apiserver", "api")
+
+			desired, err := provider.DesiredAPIServices(context.TODO())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			names := apiServiceNames(desired)
+			if len(names) != len(tc.expectedNames) {
+				t.Fatalf("expected APIServices %v, got %v", tc.expectedNames, names)
+			}
+			for i, name := range names {
+				if name != tc.expectedNames[i] {
+					t.Fatalf("expected APIServices %v, got %v", tc.expectedNames, names)
+				}
+			}
+		})
+	}
+}
+
+func TestFeatureGatedProviderOAuthHandoff(t *testing.T) {
+	provider := NewFeatureGatedProvider(newFeatureGateLister(t, &configv1.FeatureGate{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+	}), "openshift-apiserver", "api")
+
+	desired, err := provider.DesiredAPIServices(context.TODO())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, desc := range desired {
+		if desc.APIService.Name != "v1.oauth.openshift.io" {
+			continue
+		}
+		if desc.OwnedConditionType != apiServiceOAuthOwnedCondition {
+			t.Fatalf("expected oauth.openshift.io to wire OwnedConditionType %q, got %q", apiServiceOAuthOwnedCondition, desc.OwnedConditionType)
+		}
+		return
+	}
+	t.Fatal("expected v1.oauth.openshift.io in the desired APIService set")
+}